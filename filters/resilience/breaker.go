@@ -0,0 +1,237 @@
+// Package resilience provides filters.Filter implementations that guard
+// upstream dials and round trips with a circuit breaker and retry policy,
+// so operators can get this behavior without writing filters from scratch.
+package resilience
+
+import (
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/getlantern/proxy/filters"
+)
+
+// breakerState is one of the three states a per-host circuit breaker can be
+// in.
+type breakerState int
+
+const (
+	closed breakerState = iota
+	open
+	halfOpen
+)
+
+// BreakerPolicy configures the circuit breaker for a single upstream host.
+type BreakerPolicy struct {
+	// Window is the rolling window over which the failure ratio is computed.
+	Window time.Duration
+	// FailureRatio trips the breaker once the exponentially-decayed failure
+	// ratio over Window exceeds this value (e.g. 0.5 for 50%).
+	FailureRatio float64
+	// MinSamples is the minimum number of samples in Window before the
+	// breaker will consider tripping; below this it stays closed.
+	MinSamples int
+	// Cooldown is how long the breaker stays open before allowing a single
+	// half-open probe through.
+	Cooldown time.Duration
+	// Fallback, if set, is called for a short-circuited response while the
+	// breaker is open instead of failing the request outright.
+	Fallback func(ctx filters.Context, req *http.Request) (*http.Response, filters.Context, error)
+}
+
+func (p *BreakerPolicy) applyDefaults() {
+	if p.Window <= 0 {
+		p.Window = 10 * time.Second
+	}
+	if p.FailureRatio <= 0 {
+		p.FailureRatio = 0.5
+	}
+	if p.MinSamples <= 0 {
+		p.MinSamples = 10
+	}
+	if p.Cooldown <= 0 {
+		p.Cooldown = 5 * time.Second
+	}
+}
+
+// counters tracks an exponentially-decayed count of successes and failures,
+// decayed towards zero as time passes so that old samples stop influencing
+// the ratio without needing a sliding window buffer.
+type counters struct {
+	halfLife  time.Duration
+	lastDecay time.Time
+	successes float64
+	failures  float64
+}
+
+func newCounters(window time.Duration) *counters {
+	return &counters{halfLife: window, lastDecay: time.Now()}
+}
+
+func (c *counters) decay(now time.Time) {
+	elapsed := now.Sub(c.lastDecay)
+	if elapsed <= 0 {
+		return
+	}
+	factor := math.Exp(-float64(elapsed) / float64(c.halfLife))
+	c.successes *= factor
+	c.failures *= factor
+	c.lastDecay = now
+}
+
+func (c *counters) recordSuccess(now time.Time) {
+	c.decay(now)
+	c.successes++
+}
+
+func (c *counters) recordFailure(now time.Time) {
+	c.decay(now)
+	c.failures++
+}
+
+func (c *counters) samples() float64 {
+	return c.successes + c.failures
+}
+
+func (c *counters) failureRatio() float64 {
+	total := c.samples()
+	if total == 0 {
+		return 0
+	}
+	return c.failures / total
+}
+
+// hostBreaker is the per-upstream-host state machine.
+type hostBreaker struct {
+	mu        sync.Mutex
+	policy    *BreakerPolicy
+	state     breakerState
+	counters  *counters
+	openSince time.Time
+}
+
+func newHostBreaker(policy *BreakerPolicy) *hostBreaker {
+	return &hostBreaker{
+		policy:   policy,
+		state:    closed,
+		counters: newCounters(policy.Window),
+	}
+}
+
+// allow reports whether a request should be let through right now, and
+// whether doing so counts as a half-open probe.
+func (b *hostBreaker) allow() (ok bool, probe bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case closed:
+		return true, false
+	case open:
+		if time.Since(b.openSince) >= b.policy.Cooldown {
+			b.state = halfOpen
+			return true, true
+		}
+		return false, false
+	case halfOpen:
+		// Only one probe in flight at a time; further requests are rejected
+		// until the probe resolves.
+		return false, false
+	}
+	return true, false
+}
+
+func (b *hostBreaker) onResult(success bool, probe bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+
+	if probe {
+		if success {
+			b.state = closed
+			b.counters = newCounters(b.policy.Window)
+		} else {
+			b.state = open
+			b.openSince = now
+		}
+		return
+	}
+
+	if success {
+		b.counters.recordSuccess(now)
+	} else {
+		b.counters.recordFailure(now)
+	}
+
+	// The decayed sample count of N recent samples is slightly below N, so
+	// round it before comparing against MinSamples.
+	if b.state == closed && math.Round(b.counters.samples()) >= float64(b.policy.MinSamples) &&
+		b.counters.failureRatio() > b.policy.FailureRatio {
+		b.state = open
+		b.openSince = now
+	}
+}
+
+// Breaker is a filters.Filter that trips a per-host circuit breaker when the
+// rolling failure ratio for dials/round trips to that host exceeds the
+// configured threshold, short-circuiting further requests to that host
+// until a cooldown elapses and a half-open probe succeeds.
+type Breaker struct {
+	policy BreakerPolicy
+
+	mu       sync.Mutex
+	breakers map[string]*hostBreaker
+}
+
+// NewBreaker returns a Breaker filter configured by policy.
+func NewBreaker(policy BreakerPolicy) *Breaker {
+	policy.applyDefaults()
+	return &Breaker{policy: policy, breakers: make(map[string]*hostBreaker)}
+}
+
+func (f *Breaker) hostBreakerFor(host string) *hostBreaker {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	hb, ok := f.breakers[host]
+	if !ok {
+		hb = newHostBreaker(&f.policy)
+		f.breakers[host] = hb
+	}
+	return hb
+}
+
+// Apply implements filters.Filter.
+func (f *Breaker) Apply(ctx filters.Context, req *http.Request, next filters.Next) (*http.Response, filters.Context, error) {
+	host := req.URL.Host
+	hb := f.hostBreakerFor(host)
+
+	allowed, probe := hb.allow()
+	if !allowed {
+		if f.policy.Fallback != nil {
+			return f.policy.Fallback(ctx, req)
+		}
+		return filters.Fail(ctx, req, http.StatusServiceUnavailable, errCircuitOpen(host))
+	}
+
+	resp, nextCtx, err := next(ctx, req)
+	hb.onResult(isUpstreamSuccess(resp, err), probe)
+	return resp, nextCtx, err
+}
+
+func isUpstreamSuccess(resp *http.Response, err error) bool {
+	if err != nil {
+		return false
+	}
+	return resp == nil || resp.StatusCode < 500
+}
+
+type errCircuitOpenType struct{ host string }
+
+func (e errCircuitOpenType) Error() string {
+	return "circuit breaker open for " + e.host
+}
+
+func errCircuitOpen(host string) error {
+	return errCircuitOpenType{host: host}
+}
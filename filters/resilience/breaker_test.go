@@ -0,0 +1,96 @@
+package resilience
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCountersFailureRatio(t *testing.T) {
+	c := newCounters(time.Minute)
+	now := time.Now()
+
+	c.recordSuccess(now)
+	c.recordSuccess(now)
+	c.recordFailure(now)
+
+	if got := c.failureRatio(); got != 1.0/3.0 {
+		t.Errorf("failureRatio = %v, want %v", got, 1.0/3.0)
+	}
+}
+
+func TestCountersFailureRatioDecaysOverTime(t *testing.T) {
+	c := newCounters(time.Second)
+	now := time.Now()
+
+	c.recordFailure(now)
+	c.recordFailure(now)
+
+	// Advance far beyond the half-life so the old failures decay away; a
+	// fresh success should then dominate the ratio instead of being diluted
+	// by samples that should no longer count.
+	later := now.Add(10 * time.Second)
+	c.recordSuccess(later)
+
+	if got := c.failureRatio(); got > 0.1 {
+		t.Errorf("failureRatio = %v, want near 0 after old failures decayed", got)
+	}
+}
+
+func TestHostBreakerTripsOpenAfterFailureRatioExceeded(t *testing.T) {
+	policy := &BreakerPolicy{Window: time.Minute, FailureRatio: 0.5, MinSamples: 2, Cooldown: time.Minute}
+	hb := newHostBreaker(policy)
+
+	allowed, probe := hb.allow()
+	if !allowed || probe {
+		t.Fatalf("allow() = %v, %v; want true, false while closed", allowed, probe)
+	}
+	hb.onResult(false, false)
+	hb.onResult(false, false)
+
+	allowed, _ = hb.allow()
+	if allowed {
+		t.Error("allow() = true after breaker should have tripped open")
+	}
+}
+
+func TestHostBreakerHalfOpenProbeClosesOnSuccess(t *testing.T) {
+	policy := &BreakerPolicy{Window: time.Minute, FailureRatio: 0.5, MinSamples: 1, Cooldown: time.Millisecond}
+	hb := newHostBreaker(policy)
+
+	hb.onResult(false, false)
+	allowed, _ := hb.allow()
+	if allowed {
+		t.Fatal("allow() = true before cooldown elapsed")
+	}
+
+	time.Sleep(5 * time.Millisecond)
+	allowed, probe := hb.allow()
+	if !allowed || !probe {
+		t.Fatalf("allow() = %v, %v; want true, true for the half-open probe", allowed, probe)
+	}
+
+	// Only one probe in flight: a second concurrent request must be rejected.
+	if allowed, _ := hb.allow(); allowed {
+		t.Error("allow() = true for a second request while a half-open probe is already in flight")
+	}
+
+	hb.onResult(true, probe)
+	allowed, _ = hb.allow()
+	if !allowed {
+		t.Error("allow() = false after a successful half-open probe should have closed the breaker")
+	}
+}
+
+func TestHostBreakerHalfOpenProbeReopensOnFailure(t *testing.T) {
+	policy := &BreakerPolicy{Window: time.Minute, FailureRatio: 0.5, MinSamples: 1, Cooldown: time.Millisecond}
+	hb := newHostBreaker(policy)
+
+	hb.onResult(false, false)
+	time.Sleep(5 * time.Millisecond)
+	_, probe := hb.allow()
+
+	hb.onResult(false, probe)
+	if allowed, _ := hb.allow(); allowed {
+		t.Error("allow() = true immediately after a failed half-open probe should have reopened the breaker")
+	}
+}
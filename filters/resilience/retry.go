@@ -0,0 +1,129 @@
+package resilience
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/getlantern/proxy/filters"
+)
+
+// RetryPolicy configures idempotent retries for upstream requests.
+type RetryPolicy struct {
+	// MaxRetries is how many additional attempts are made after the first.
+	MaxRetries int
+	// BaseDelay is the base of the jittered exponential backoff between
+	// attempts: attempt N waits in [0, BaseDelay*2^N).
+	BaseDelay time.Duration
+	// MaxBufferBytes is the largest request body RetryFilter will buffer in
+	// order to allow replaying it; requests with larger or unknown-length
+	// bodies are not retried.
+	MaxBufferBytes int64
+	// RetryConnect enables retrying CONNECT requests. It only makes sense
+	// when the proxy is configured to wait for the upstream dial before
+	// responding to CONNECT (OKWaitsForUpstream): otherwise the 200 OK for
+	// CONNECT is written before the dial happens, so the actual dial failure
+	// occurs outside this filter chain and there's nothing here to retry.
+	RetryConnect bool
+}
+
+func (p *RetryPolicy) applyDefaults() {
+	if p.MaxRetries <= 0 {
+		p.MaxRetries = 2
+	}
+	if p.BaseDelay <= 0 {
+		p.BaseDelay = 100 * time.Millisecond
+	}
+	if p.MaxBufferBytes <= 0 {
+		p.MaxBufferBytes = 64 * 1024
+	}
+}
+
+// Retry is a filters.Filter that retries GET/HEAD requests (and CONNECT, if
+// policy.RetryConnect is set) on dial failure or a 502/503/504 response,
+// using jittered exponential backoff. It only retries requests whose body
+// (if any) is small enough to buffer and replay; larger or streaming bodies
+// are passed through once, un-retried.
+type Retry struct {
+	policy RetryPolicy
+}
+
+// NewRetry returns a Retry filter configured by policy.
+func NewRetry(policy RetryPolicy) *Retry {
+	policy.applyDefaults()
+	return &Retry{policy: policy}
+}
+
+func isIdempotent(method string, retryConnect bool) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead:
+		return true
+	case http.MethodConnect:
+		return retryConnect
+	}
+	return false
+}
+
+func isRetriableStatus(code int) bool {
+	switch code {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// Apply implements filters.Filter.
+func (f *Retry) Apply(ctx filters.Context, req *http.Request, next filters.Next) (*http.Response, filters.Context, error) {
+	if !isIdempotent(req.Method, f.policy.RetryConnect) {
+		return next(ctx, req)
+	}
+
+	var bodyBytes []byte
+	if req.Body != nil && req.ContentLength >= 0 && req.ContentLength <= f.policy.MaxBufferBytes {
+		b, err := ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return filters.Fail(ctx, req, http.StatusBadGateway, err)
+		}
+		bodyBytes = b
+	} else if req.Body != nil {
+		// Body is too large (or of unknown length) to safely replay; make a
+		// single, non-retried attempt.
+		return next(ctx, req)
+	}
+
+	var resp *http.Response
+	var nextCtx filters.Context = ctx
+	var err error
+
+	for attempt := 0; attempt <= f.policy.MaxRetries; attempt++ {
+		if bodyBytes != nil {
+			req.Body = ioutil.NopCloser(bytes.NewReader(bodyBytes))
+		}
+
+		resp, nextCtx, err = next(nextCtx, req)
+		if err == nil && (resp == nil || !isRetriableStatus(resp.StatusCode)) {
+			return resp, nextCtx, err
+		}
+		if attempt == f.policy.MaxRetries {
+			break
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+		time.Sleep(jitteredBackoff(f.policy.BaseDelay, attempt))
+	}
+
+	return resp, nextCtx, err
+}
+
+// jitteredBackoff returns a random duration in [0, base*2^attempt).
+func jitteredBackoff(base time.Duration, attempt int) time.Duration {
+	max := base << uint(attempt)
+	if max <= 0 {
+		return base
+	}
+	return time.Duration(rand.Int63n(int64(max)))
+}
@@ -0,0 +1,160 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/proxy/filters"
+	"golang.org/x/net/http2"
+)
+
+// http2Preface is the fixed connection preface that an HTTP/2 (or h2c)
+// client sends before any frames, as defined in RFC 7540 section 3.5. We use
+// it to recognize h2c connections that arrive without TLS/ALPN to tell us
+// what's coming.
+const http2Preface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+func (opts *Opts) applyH2Defaults() {
+	if opts.AllowH2 || opts.H2CUpgrade {
+		if opts.h2Server == nil {
+			opts.h2Server = &http2.Server{}
+		}
+	}
+}
+
+// looksLikeH2C peeks at downstreamBuffered without consuming it to determine
+// whether the client opened the connection with the HTTP/2 connection
+// preface rather than an HTTP/1.x request line.
+func looksLikeH2C(downstreamBuffered *bufio.Reader) bool {
+	preface, err := downstreamBuffered.Peek(len(http2Preface))
+	if err != nil {
+		return false
+	}
+	return string(preface) == http2Preface
+}
+
+// negotiatedH2 reports whether conn is a TLS connection whose handshake
+// settled on ALPN protocol "h2", as happens when proxy.mitmIC is configured
+// to advertise h2 among the protocols it offers downstream.
+func negotiatedH2(conn net.Conn) bool {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return false
+	}
+	return tlsConn.ConnectionState().NegotiatedProtocol == http2.NextProtoTLS
+}
+
+// serveH2 takes over downstream, which has already announced itself as
+// HTTP/2 (via the h2c preface on a plaintext connection, or via ALPN on a
+// MITM'd TLS connection), and dispatches every request it produces through
+// the same filters.Chain used for HTTP/1.x traffic.
+func (proxy *proxy) serveH2(ctx context.Context, downstream net.Conn) error {
+	if proxy.h2Server == nil {
+		return errors.New("received an HTTP/2 connection but AllowH2/H2CUpgrade is not enabled")
+	}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if err := proxy.serveH2Request(ctx, downstream, w, req); err != nil {
+			log.Errorf("Error serving HTTP/2 request: %v", err)
+		}
+	})
+	proxy.h2Server.ServeConn(downstream, &http2.ServeConnOpts{Handler: handler})
+	return nil
+}
+
+// serveH2Request runs a single HTTP/2 stream through proxy.Filter, round
+// tripping upstream through proxy.h2Transport(), which itself negotiates h2
+// vs HTTP/1.1 per dial target.
+func (proxy *proxy) serveH2Request(ctx context.Context, downstream net.Conn, w http.ResponseWriter, req *http.Request) error {
+	fctx := filters.WrapContext(withAwareConn(ctx), downstream)
+	// http2.Server sets req.TLS when the downstream conn satisfies the TLS
+	// connection-state interface, i.e. whenever it's MITM'd; a bare h2c
+	// connection over plaintext leaves it nil. Mirror the scheme that
+	// implies rather than hardcoding https, or h2c requests end up round
+	// tripped to the wrong origin scheme.
+	if req.TLS != nil {
+		req.URL.Scheme = "https"
+	} else {
+		req.URL.Scheme = "http"
+	}
+	req.URL.Host = req.Host
+
+	next := func(fctx filters.Context, modifiedReq *http.Request) (*http.Response, filters.Context, error) {
+		modifiedReq = modifiedReq.WithContext(fctx)
+		setRequestForAwareConn(fctx, modifiedReq)
+		handleRequestAware(fctx)
+		resp, err := proxy.h2Transport().RoundTrip(prepareRequest(modifiedReq))
+		handleResponseAware(fctx, modifiedReq, resp, err)
+		return resp, fctx, err
+	}
+
+	resp, fctx, err := proxy.Filter.Apply(fctx, req, next)
+	if err != nil && resp == nil {
+		resp = proxy.OnError(fctx, req, false, err)
+	}
+	if resp == nil {
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return err
+	}
+	defer resp.Body.Close()
+	copyHeadersForForwarding(w.Header(), resp.Header)
+	w.WriteHeader(resp.StatusCode)
+	_, copyErr := io.Copy(w, resp.Body)
+	if copyErr != nil {
+		return errors.New("Error copying HTTP/2 response body: %v", copyErr)
+	}
+	return nil
+}
+
+// h2Transport lazily builds, and caches on proxy, the RoundTripper used for
+// outbound HTTP/2 stream requests, so repeated requests share the same
+// connection (and its h2 multiplexing) instead of each paying for a fresh
+// TLS handshake. It's a regular *http.Transport dialing through proxy.Dial,
+// upgraded by http2.ConfigureTransport: that hands a connection off to HTTP/2
+// only if the origin's ALPN negotiation actually selects "h2", and otherwise
+// leaves it to the *http.Transport to speak ordinary HTTP/1.1 — so origins
+// that don't support h2 still work instead of failing outright.
+func (proxy *proxy) h2Transport() http.RoundTripper {
+	proxy.h2TransportOnce.Do(func() {
+		t1 := &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return proxy.Dial(ctx, false, network, addr)
+			},
+			DialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				conn, err := proxy.Dial(ctx, false, network, addr)
+				if err != nil {
+					return nil, err
+				}
+				tlsConn := tls.Client(conn, &tls.Config{
+					ServerName: tlsServerName(addr),
+					NextProtos: []string{http2.NextProtoTLS, "http/1.1"},
+				})
+				if handshakeErr := tlsConn.HandshakeContext(ctx); handshakeErr != nil {
+					conn.Close()
+					return nil, handshakeErr
+				}
+				return tlsConn, nil
+			},
+		}
+		if err := http2.ConfigureTransport(t1); err != nil {
+			log.Errorf("Unable to configure HTTP/2 transport, falling back to HTTP/1.1 only: %v", err)
+		}
+		proxy.h2tr = t1
+	})
+	return proxy.h2tr
+}
+
+// tlsServerName strips the port off addr (as returned by net.JoinHostPort)
+// for use as the TLS ServerName/SNI, falling back to addr unchanged if it
+// doesn't contain a port.
+func tlsServerName(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
@@ -0,0 +1,371 @@
+package proxy
+
+import (
+	"container/list"
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// upstreamPool lazily builds the proxy's shared UpstreamPool the first time
+// it's called, so that a proxy which never calls it never pays for a reaper
+// goroutine. The non-CONNECT path does not go through it: httpTransport dials
+// through proxy.Dial directly.
+func (proxy *proxy) upstreamPool() *UpstreamPool {
+	proxy.poolOnce.Do(func() {
+		proxy.pool = NewUpstreamPool(proxy.Dial, proxy.MaxIdleConnsPerHost, proxy.MaxConnsPerHost, proxy.IdleConnTimeout)
+	})
+	return proxy.pool
+}
+
+// httpTransport lazily builds, and caches on proxy, the *http.Transport used
+// to round trip ordinary (non-CONNECT, non-MITM-passthrough) requests. It's
+// built once and shared across every downstream connection rather than
+// rebuilt per connection, and deliberately leaves MaxIdleConnsPerHost at its
+// configured, positive value: net/http treats a negative value the same as
+// DisableKeepAlives, closing every connection (sending a real TLS
+// close_notify for HTTPS origins) immediately after each response, which
+// defeats the point of sharing one Transport in the first place. It dials
+// straight through proxy.Dial rather than through UpstreamPool, the same way
+// h2Transport does: stacking UpstreamPool's own pooling underneath a
+// Transport that already pools its own idle connections just leaves the two
+// layers disagreeing about which connections are actually in use.
+func (proxy *proxy) httpTransport() *http.Transport {
+	proxy.httpTransportOnce.Do(func() {
+		proxy.transport = &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return proxy.Dial(ctx, false, network, addr)
+			},
+			MaxIdleConnsPerHost: proxy.MaxIdleConnsPerHost,
+			MaxConnsPerHost:     proxy.MaxConnsPerHost,
+			IdleConnTimeout:     proxy.IdleConnTimeout,
+		}
+	})
+	return proxy.transport
+}
+
+func (opts *Opts) applyPoolDefaults() {
+	if opts.MaxIdleConnsPerHost == 0 {
+		opts.MaxIdleConnsPerHost = 2
+	}
+	if opts.IdleConnTimeout == 0 {
+		opts.IdleConnTimeout = 90 * time.Second
+	}
+	if opts.DialTimeout == 0 {
+		opts.DialTimeout = 30 * time.Second
+	}
+}
+
+// poolKey identifies the (scheme, host) bucket a pooled connection belongs
+// to, mirroring the keying net/http.Transport uses internally.
+type poolKey struct {
+	scheme string
+	host   string
+}
+
+// pooledConn is an idle upstream connection sitting in an UpstreamPool,
+// tagged with when it became idle so the reaper can expire it.
+type pooledConn struct {
+	net.Conn
+	idleSince time.Time
+}
+
+// UpstreamPool is a shared, per-(scheme,host) pool of upstream connections,
+// analogous to the pooling net/http.Transport does internally, except
+// shared across every downstream connection handled by proxy rather than
+// recreated per connection.
+type UpstreamPool struct {
+	maxIdlePerHost int
+	maxPerHost     int
+	idleTimeout    time.Duration
+	dial           DialFunc
+
+	mu      sync.Mutex
+	idle    map[poolKey]*list.List
+	inUse   map[poolKey]int
+	waiters map[poolKey][]chan struct{}
+
+	closeCh   chan struct{}
+	closeOnce sync.Once
+
+	hits, misses, expired int64
+}
+
+// NewUpstreamPool creates an UpstreamPool backed by dial, and starts a
+// background reaper that expires idle connections older than idleTimeout.
+func NewUpstreamPool(dial DialFunc, maxIdlePerHost, maxPerHost int, idleTimeout time.Duration) *UpstreamPool {
+	p := &UpstreamPool{
+		maxIdlePerHost: maxIdlePerHost,
+		maxPerHost:     maxPerHost,
+		idleTimeout:    idleTimeout,
+		dial:           dial,
+		idle:           make(map[poolKey]*list.List),
+		inUse:          make(map[poolKey]int),
+		waiters:        make(map[poolKey][]chan struct{}),
+		closeCh:        make(chan struct{}),
+	}
+	go p.reap()
+	return p
+}
+
+// Stats summarizes UpstreamPool activity for operators.
+type Stats struct {
+	Hits, Misses, Expired int64
+	InUse, Idle           int
+}
+
+// Stats returns a point-in-time snapshot of pool activity.
+func (p *UpstreamPool) Stats() Stats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	stats := Stats{Hits: p.hits, Misses: p.misses, Expired: p.expired}
+	for _, n := range p.inUse {
+		stats.InUse += n
+	}
+	for _, l := range p.idle {
+		stats.Idle += l.Len()
+	}
+	return stats
+}
+
+// Get returns an idle connection to (scheme, host) if one is available,
+// dials a new one if the host hasn't reached MaxConnsPerHost, or blocks
+// until a connection frees up or ctx is done. Idle connections are health
+// checked before being handed out (see connAppearsAlive); a connection that
+// the peer has since closed is discarded rather than returned, and Get
+// tries again instead of handing back a dead socket.
+func (p *UpstreamPool) Get(ctx context.Context, scheme, host string) (net.Conn, error) {
+	key := poolKey{scheme: scheme, host: host}
+	for {
+		p.mu.Lock()
+		if l, ok := p.idle[key]; ok && l.Len() > 0 {
+			pc := l.Remove(l.Front()).(*pooledConn)
+			p.mu.Unlock()
+			if !connAppearsAlive(pc.Conn) {
+				pc.Conn.Close()
+				continue
+			}
+			p.mu.Lock()
+			p.inUse[key]++
+			p.hits++
+			p.mu.Unlock()
+			return pc.Conn, nil
+		}
+		if p.maxPerHost <= 0 || p.inUse[key] < p.maxPerHost {
+			p.inUse[key]++
+			p.misses++
+			p.mu.Unlock()
+			conn, err := p.dial(ctx, false, scheme, host)
+			if err != nil {
+				p.mu.Lock()
+				p.inUse[key]--
+				p.mu.Unlock()
+				return nil, err
+			}
+			return conn, nil
+		}
+		wait := make(chan struct{})
+		p.waiters[key] = append(p.waiters[key], wait)
+		p.mu.Unlock()
+
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// connAppearsAlive does a cheap liveness probe on an idle connection before
+// it's handed back out, the same trick net/http and database/sql use: set a
+// short read deadline and attempt a non-blocking read. A timeout means
+// nothing's arrived, i.e. the connection is still idle and presumably fine;
+// any other outcome (EOF, reset, unexpected pipelined bytes) means it can't
+// be safely reused.
+func connAppearsAlive(conn net.Conn) bool {
+	if err := conn.SetReadDeadline(time.Now().Add(time.Millisecond)); err != nil {
+		// Can't probe this conn type; assume it's fine rather than discarding
+		// connections needlessly.
+		return true
+	}
+	defer conn.SetReadDeadline(time.Time{})
+
+	var b [1]byte
+	n, err := conn.Read(b[:])
+	if n > 0 {
+		// The peer sent unsolicited bytes while we thought this connection was
+		// idle; we have nowhere to put them back, so don't reuse it.
+		return false
+	}
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return true
+	}
+	return false
+}
+
+// Put returns conn to the idle pool for (scheme, host), or closes it if the
+// pool for that host is already at MaxIdleConnsPerHost.
+func (p *UpstreamPool) Put(scheme, host string, conn net.Conn) {
+	key := poolKey{scheme: scheme, host: host}
+	p.mu.Lock()
+	p.inUse[key]--
+
+	l, ok := p.idle[key]
+	if !ok {
+		l = list.New()
+		p.idle[key] = l
+	}
+	if p.maxIdlePerHost > 0 && l.Len() >= p.maxIdlePerHost {
+		p.mu.Unlock()
+		conn.Close()
+	} else {
+		l.PushBack(&pooledConn{Conn: conn, idleSince: time.Now()})
+		p.mu.Unlock()
+	}
+
+	p.wakeWaiter(key)
+}
+
+// discard closes conn outright instead of returning it to the idle pool,
+// for use when the caller knows the connection ended its last use in error
+// (see returningConn) and so can't safely be handed to a different
+// downstream client.
+func (p *UpstreamPool) discard(scheme, host string, conn net.Conn) {
+	key := poolKey{scheme: scheme, host: host}
+	conn.Close()
+	p.mu.Lock()
+	p.inUse[key]--
+	p.mu.Unlock()
+	p.wakeWaiter(key)
+}
+
+// wakeWaiter wakes at most one goroutine blocked in Get for key, now that
+// inUse dropped or an idle connection became available.
+func (p *UpstreamPool) wakeWaiter(key poolKey) {
+	p.mu.Lock()
+	waiters := p.waiters[key]
+	var woken chan struct{}
+	if len(waiters) > 0 {
+		woken, p.waiters[key] = waiters[0], waiters[1:]
+	}
+	p.mu.Unlock()
+	if woken != nil {
+		close(woken)
+	}
+}
+
+// reap periodically closes idle connections that have exceeded idleTimeout.
+func (p *UpstreamPool) reap() {
+	ticker := time.NewTicker(p.idleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.reapOnce()
+		case <-p.closeCh:
+			return
+		}
+	}
+}
+
+func (p *UpstreamPool) reapOnce() {
+	cutoff := time.Now().Add(-p.idleTimeout)
+	var toClose []net.Conn
+
+	p.mu.Lock()
+	for key, l := range p.idle {
+		for e := l.Front(); e != nil; {
+			next := e.Next()
+			pc := e.Value.(*pooledConn)
+			if pc.idleSince.Before(cutoff) {
+				toClose = append(toClose, pc.Conn)
+				l.Remove(e)
+				p.expired++
+			}
+			e = next
+		}
+		if l.Len() == 0 {
+			delete(p.idle, key)
+		}
+	}
+	p.mu.Unlock()
+
+	for _, conn := range toClose {
+		conn.Close()
+	}
+}
+
+// DialContext returns a connection to (network, addr), transparently reusing
+// a pooled idle connection when one is available. Closing the returned
+// connection returns it to the pool instead of tearing down the socket.
+func (p *UpstreamPool) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := p.Get(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return &returningConn{Conn: conn, pool: p, scheme: network, host: addr}, nil
+}
+
+// returningConn wraps a pooled net.Conn so that closing it (as net/http does
+// once it believes a connection is no longer needed) hands it back to the
+// UpstreamPool rather than closing the underlying socket. It also tracks
+// whether the last read or write on the connection ended in an error, so
+// that Close can discard rather than recycle a connection whose state we
+// can no longer vouch for (e.g. the downstream write failed partway through
+// a response body, leaving the upstream socket mid-message).
+type returningConn struct {
+	net.Conn
+	pool         *UpstreamPool
+	scheme, host string
+	closed       bool
+	broken       bool
+}
+
+func (c *returningConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if err != nil {
+		// EOF here means the peer closed the socket, not just the end of a
+		// message the caller knew the length of in advance; either way we
+		// can't trust this connection's state anymore.
+		c.broken = true
+	}
+	return n, err
+}
+
+func (c *returningConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if err != nil {
+		c.broken = true
+	}
+	return n, err
+}
+
+func (c *returningConn) Close() error {
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	if c.broken {
+		c.pool.discard(c.scheme, c.host, c.Conn)
+		return nil
+	}
+	c.pool.Put(c.scheme, c.host, c.Conn)
+	return nil
+}
+
+// Close stops the reaper and closes every idle connection in the pool.
+func (p *UpstreamPool) Close() {
+	p.closeOnce.Do(func() {
+		close(p.closeCh)
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		for _, l := range p.idle {
+			for e := l.Front(); e != nil; e = e.Next() {
+				e.Value.(*pooledConn).Conn.Close()
+			}
+		}
+		p.idle = make(map[poolKey]*list.List)
+	})
+}
@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// pipeDialer returns a DialFunc that hands out one end of an in-memory
+// net.Pipe connection each time it's called, while stashing the other end
+// (the simulated peer) so tests can poke at it, and counts how many times
+// it dialed.
+type pipeDialer struct {
+	dials int32
+	peers chan net.Conn
+}
+
+func newPipeDialer() *pipeDialer {
+	return &pipeDialer{peers: make(chan net.Conn, 16)}
+}
+
+func (d *pipeDialer) dial(ctx context.Context, isConnect bool, network, addr string) (net.Conn, error) {
+	atomic.AddInt32(&d.dials, 1)
+	client, peer := net.Pipe()
+	d.peers <- peer
+	return client, nil
+}
+
+func TestUpstreamPoolReusesIdleConnection(t *testing.T) {
+	d := newPipeDialer()
+	p := NewUpstreamPool(d.dial, 2, 0, time.Minute)
+	defer p.Close()
+
+	conn, err := p.DialContext(context.Background(), "tcp", "example.com:80")
+	if err != nil {
+		t.Fatalf("DialContext: %v", err)
+	}
+	if err := conn.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	conn2, err := p.DialContext(context.Background(), "tcp", "example.com:80")
+	if err != nil {
+		t.Fatalf("second DialContext: %v", err)
+	}
+	defer conn2.Close()
+
+	if got := atomic.LoadInt32(&d.dials); got != 1 {
+		t.Errorf("dials = %d, want 1 (second Get should have reused the pooled connection)", got)
+	}
+}
+
+func TestUpstreamPoolDiscardsBrokenConnection(t *testing.T) {
+	d := newPipeDialer()
+	p := NewUpstreamPool(d.dial, 2, 0, time.Minute)
+	defer p.Close()
+
+	conn, err := p.DialContext(context.Background(), "tcp", "example.com:80")
+	if err != nil {
+		t.Fatalf("DialContext: %v", err)
+	}
+	peer := <-d.peers
+
+	// Simulate the origin closing the connection while we were using it,
+	// then mark the connection broken the way a RoundTrip that hit a read
+	// error would, via the wrapped Read.
+	peer.Close()
+	buf := make([]byte, 1)
+	conn.Read(buf) // expected to fail now that the peer is gone; marks returningConn.broken
+
+	if err := conn.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	conn2, err := p.DialContext(context.Background(), "tcp", "example.com:80")
+	if err != nil {
+		t.Fatalf("second DialContext: %v", err)
+	}
+	defer conn2.Close()
+
+	if got := atomic.LoadInt32(&d.dials); got != 2 {
+		t.Errorf("dials = %d, want 2 (broken connection should not have been reused)", got)
+	}
+}
+
+func TestUpstreamPoolReapExpiresIdleConnections(t *testing.T) {
+	d := newPipeDialer()
+	p := NewUpstreamPool(d.dial, 2, 0, time.Millisecond)
+	defer p.Close()
+
+	conn, err := p.DialContext(context.Background(), "tcp", "example.com:80")
+	if err != nil {
+		t.Fatalf("DialContext: %v", err)
+	}
+	if err := conn.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	time.Sleep(5 * time.Millisecond)
+	p.reapOnce()
+
+	if stats := p.Stats(); stats.Idle != 0 {
+		t.Errorf("Idle = %d, want 0 after reapOnce expired the idle connection", stats.Idle)
+	}
+}
@@ -118,9 +118,12 @@ func (proxy *proxy) proceedWithConnect(ctx filters.Context, upstreamAddr string,
 	}()
 
 	var rr io.Reader
+	var mitming bool
 	if proxy.mitmIC != nil {
 		// Try to MITM the connection
-		downstreamMITM, upstreamMITM, mitming, err := proxy.mitmIC.MITM(downstream, upstream)
+		var downstreamMITM, upstreamMITM net.Conn
+		var err error
+		downstreamMITM, upstreamMITM, mitming, err = proxy.mitmIC.MITM(downstream, upstream)
 		if err != nil {
 			log.Errorf("Unable to MITM %v: %v", upstreamAddr, err)
 			return errors.New("Unable to MITM connection: %v", err)
@@ -135,6 +138,14 @@ func (proxy *proxy) proceedWithConnect(ctx filters.Context, upstreamAddr string,
 			}
 		}
 
+		if mitming && proxy.AllowH2 && negotiatedH2(downstream) {
+			// The MITM'd TLS handshake advertised and negotiated h2 via ALPN, so
+			// there's no HTTP/1.x request line to peek at; hand the connection
+			// straight to the HTTP/2 server loop.
+			ctx = ctx.WithValue(ctxKeyUpstream, nil).WithValue(ctxKeyUpstreamAddr, nil)
+			return proxy.serveH2(ctx, downstream)
+		}
+
 		if mitming {
 			// Try to read HTTP request and process as HTTP assuming that requests
 			// (not including body) are always smaller than 65K. If this assumption is
@@ -176,8 +187,19 @@ func (proxy *proxy) proceedWithConnect(ctx filters.Context, upstreamAddr string,
 		}
 	}
 
-	// Pipe data between the client and the proxy.
-	writeErr, readErr := netx.BidiCopy(upstream, downstream, bufOut, bufIn)
+	// Pipe data between the client and the proxy, counting bytes in each
+	// direction so we can emit a synthetic HAR-style entry for the tunnel.
+	var bytesUp, bytesDown int64
+	var writeErr, readErr error
+	if !mitming {
+		// Not MITM'ing, so there's no need to inspect the bytes flowing
+		// through this tunnel; let SpliceCopy take the zero-copy path when
+		// it can.
+		bytesUp, bytesDown, writeErr, readErr = proxy.SpliceCopy(upstream, downstream, bufOut, bufIn)
+	} else {
+		bytesUp, bytesDown, writeErr, readErr = bufferedCopy(upstream, downstream, bufOut, bufIn)
+	}
+	proxy.recordConnect(ctx, upstreamAddr, bytesUp, bytesDown)
 	if isUnexpected(readErr) {
 		return errors.New("Error piping data to downstream: %v", readErr)
 	} else if isUnexpected(writeErr) {
@@ -186,6 +208,20 @@ func (proxy *proxy) proceedWithConnect(ctx filters.Context, upstreamAddr string,
 	return nil
 }
 
+// byteCountingConn wraps a net.Conn to track the number of bytes read from
+// it, used to report bytesUp/bytesDown to proxy.Recorder for CONNECT
+// tunnels.
+type byteCountingConn struct {
+	net.Conn
+	read int64
+}
+
+func (c *byteCountingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.read += int64(n)
+	return n, err
+}
+
 func badGateway(ctx filters.Context, req *http.Request, err error) (*http.Response, filters.Context, error) {
 	log.Debugf("Responding BadGateway: %v", err)
 	return filters.Fail(ctx, req, http.StatusBadGateway, err)
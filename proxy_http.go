@@ -8,6 +8,7 @@ import (
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
 	"strings"
 	"time"
@@ -16,6 +17,7 @@ import (
 	"github.com/getlantern/netx"
 	"github.com/getlantern/preconn"
 	"github.com/getlantern/proxy/filters"
+	"github.com/getlantern/proxy/filters/resilience"
 )
 
 func (opts *Opts) applyHTTPDefaults() {
@@ -31,6 +33,20 @@ func (opts *Opts) applyHTTPDefaults() {
 			return next(ctx, req)
 		}), opts.Filter)
 	}
+	// BreakerPolicy and RetryPolicy, if configured, wrap the rest of the
+	// chain so they see every request that would otherwise go upstream.
+	// Breaker is joined first so it ends up innermost, closest to the actual
+	// upstream call: each of Retry's attempts re-enters the breaker, instead
+	// of Retry's internal loop firing off multiple real requests behind a
+	// breaker that only got consulted once.
+	if opts.BreakerPolicy != nil {
+		opts.Filter = filters.Join(resilience.NewBreaker(*opts.BreakerPolicy), opts.Filter)
+	}
+	if opts.RetryPolicy != nil {
+		retryPolicy := *opts.RetryPolicy
+		retryPolicy.RetryConnect = opts.OKWaitsForUpstream
+		opts.Filter = filters.Join(resilience.NewRetry(retryPolicy), opts.Filter)
+	}
 }
 
 // Handle implements the interface Proxy
@@ -70,6 +86,20 @@ func (proxy *proxy) handle(ctx context.Context, downstreamIn io.Reader, downstre
 	}()
 
 	downstreamBuffered := bufio.NewReader(downstreamIn)
+
+	if (proxy.AllowH2 && negotiatedH2(downstream)) || (proxy.H2CUpgrade && looksLikeH2C(downstreamBuffered)) {
+		// looksLikeH2C peeked the connection preface (and possibly more) into
+		// downstreamBuffered; http2.Server.ServeConn re-reads and validates
+		// that preface itself directly off the conn we hand it, so those
+		// bytes have to be replayed onto downstream or every h2c connection
+		// fails the preface check. Same trick used for CONNECT below.
+		if buffered := downstreamBuffered.Buffered(); buffered > 0 {
+			b, _ := downstreamBuffered.Peek(buffered)
+			downstream = preconn.Wrap(downstream, b)
+		}
+		return proxy.serveH2(ctx, downstream)
+	}
+
 	fctx := filters.WrapContext(withAwareConn(ctx), downstream)
 
 	// Read initial request
@@ -101,10 +131,11 @@ func (proxy *proxy) handle(ctx context.Context, downstreamIn io.Reader, downstre
 	if req.Method == http.MethodConnect {
 		next = proxy.nextCONNECT(downstream)
 	} else {
-		var tr *http.Transport
-		if upstream != nil {
+		var tr http.RoundTripper
+		shared := upstream == nil
+		if !shared {
 			setUpstreamForAwareConn(fctx, upstream)
-			tr = &http.Transport{
+			oneShot := &http.Transport{
 				DialContext: func(ctx context.Context, net, addr string) (net.Conn, error) {
 					// always use the supplied upstream connection, but don't allow it to
 					// be closed by the transport
@@ -115,31 +146,48 @@ func (proxy *proxy) handle(ctx context.Context, downstreamIn io.Reader, downstre
 				// it
 				MaxIdleConnsPerHost: -1,
 			}
+			defer oneShot.CloseIdleConnections()
+			tr = oneShot
 		} else {
-			tr = &http.Transport{
-				DialContext: func(ctx context.Context, net, addr string) (net.Conn, error) {
-					conn, err := proxy.Dial(ctx, false, net, addr)
-					if err == nil {
-						// On first dialing conn, handle RequestAware
-						setUpstreamForAwareConn(ctx, conn)
-						handleRequestAware(ctx)
-					}
-					return conn, err
-				},
-				IdleConnTimeout: proxy.IdleTimeout,
-				// since we have one transport per downstream connection, we don't need
-				// more than this
-				MaxIdleConnsPerHost: 1,
-			}
+			// Shared across every downstream connection, not rebuilt here, so
+			// upstream connections (and their TLS handshakes) are actually
+			// reused instead of torn down after every response; see
+			// httpTransport's doc comment for why this can't be a fresh
+			// per-connection Transport with MaxIdleConnsPerHost: -1.
+			tr = proxy.httpTransport()
 		}
 
-		defer tr.CloseIdleConnections()
 		next = func(ctx filters.Context, modifiedReq *http.Request) (*http.Response, filters.Context, error) {
-			modifiedReq = modifiedReq.WithContext(ctx)
+			modifiedReq = modifiedReq.WithContext(proxy.withRecorderTrace(ctx, modifiedReq))
 			setRequestForAwareConn(ctx, modifiedReq)
-			handleRequestAware(ctx)
-			resp, err := tr.RoundTrip(prepareRequest(modifiedReq))
+			if shared {
+				// The shared Transport may satisfy this RoundTrip with a warm
+				// connection it already had idle, without ever calling
+				// DialContext, so the upstream conn has to be captured via
+				// httptrace on every request instead of only on a cache-miss
+				// dial.
+				modifiedReq = modifiedReq.WithContext(httptrace.WithClientTrace(modifiedReq.Context(), &httptrace.ClientTrace{
+					GotConn: func(info httptrace.GotConnInfo) {
+						setUpstreamForAwareConn(ctx, info.Conn)
+						handleRequestAware(ctx)
+					},
+				}))
+			} else {
+				handleRequestAware(ctx)
+			}
+			prepare := prepareRequest
+			if isUpgradeCtx(ctx) {
+				prepare = prepareUpgradeRequest
+			}
+			// Record the request only after prepare has rewritten it in
+			// place: recorders like DumpRecorder capture the raw wire bytes
+			// at call time, so recording before prepare would dump the
+			// pre-rewrite request instead of what's actually sent upstream.
+			preparedReq := prepare(modifiedReq)
+			proxy.recordRequest(ctx, preparedReq)
+			resp, err := tr.RoundTrip(preparedReq)
 			handleResponseAware(ctx, modifiedReq, resp, err)
+			proxy.recordResponse(ctx, preparedReq, resp)
 			return resp, ctx, err
 		}
 	}
@@ -162,7 +210,28 @@ func (proxy *proxy) processRequests(ctx filters.Context, remoteAddr string, req
 		if req.Host == "" {
 			req.Host = origHost(ctx)
 		}
-		resp, ctx, err = proxy.Filter.Apply(ctx, req, next)
+		if proxy.isUpgradeRequest(req) {
+			// Same as the buffered-bytes preservation done for CONNECT below:
+			// downstreamBuffered may have already pulled bytes of the first
+			// upgraded frame off the wire while parsing req's headers, and
+			// proceedWithUpgrade takes over the raw downstream conn directly,
+			// so those bytes have to be replayed onto it or they're silently
+			// dropped before BidiCopy starts piping.
+			if buffered := downstreamBuffered.Buffered(); buffered > 0 {
+				b, _ := downstreamBuffered.Peek(buffered)
+				downstream = preconn.Wrap(downstream, b)
+			}
+			resp, ctx, err = proxy.Filter.Apply(ctx, req, func(fctx filters.Context, modifiedReq *http.Request) (*http.Response, filters.Context, error) {
+				return proxy.proceedWithUpgrade(fctx, modifiedReq, downstream, next)
+			})
+			if resp == nil && err == nil {
+				// proceedWithUpgrade already piped the upgraded connection to
+				// completion.
+				return nil
+			}
+		} else {
+			resp, ctx, err = proxy.Filter.Apply(ctx, req, next)
+		}
 		if err != nil && resp == nil {
 			resp = proxy.OnError(ctx, req, false, err)
 		}
@@ -191,7 +260,7 @@ func (proxy *proxy) processRequests(ctx filters.Context, remoteAddr string, req
 		}
 
 		if isConnect {
-			return proxy.proceedWithConnect(ctx, req, upstreamAddr, upstream, downstream)
+			return proxy.proceedWithConnect(ctx, upstreamAddr, upstream, downstream)
 		}
 
 		if req.Close {
@@ -288,6 +357,26 @@ func (proxy *proxy) writeResponse(downstream io.Writer, req *http.Request, resp
 
 // prepareRequest prepares the request in line with the HTTP spec for proxies.
 func prepareRequest(req *http.Request) *http.Request {
+	return prepareOutboundRequest(req, copyHeadersForForwarding)
+}
+
+// prepareUpgradeRequest is like prepareRequest, except it preserves the
+// Connection/Upgrade headers that copyHeadersForForwarding strips as
+// hop-by-hop, and keeps a single copy of each Sec-WebSocket-* header.
+// Those are exactly the headers that ask the origin to
+// switch protocols, so stripping them here would mean the origin never
+// replies 101 and proceedWithUpgrade's hijack/pipe never engages.
+func prepareUpgradeRequest(req *http.Request) *http.Request {
+	return prepareOutboundRequest(req, func(dst, src http.Header) {
+		copyHeadersForForwarding(dst, src)
+		copyUpgradeHeaders(dst, src)
+	})
+}
+
+// prepareOutboundRequest applies the header/URL/proto rewriting common to
+// prepareRequest and prepareUpgradeRequest, using copyHeaders to build the
+// outbound header set.
+func prepareOutboundRequest(req *http.Request, copyHeaders func(dst, src http.Header)) *http.Request {
 	req.Proto = "HTTP/1.1"
 	req.ProtoMajor = 1
 	req.ProtoMinor = 1
@@ -296,7 +385,7 @@ func prepareRequest(req *http.Request) *http.Request {
 
 	// Request Header
 	newHeader := make(http.Header)
-	copyHeadersForForwarding(newHeader, req.Header)
+	copyHeaders(newHeader, req.Header)
 	// Ensure we have a HOST header (important for Go 1.6+ because http.Server
 	// strips the HOST header from the inbound request)
 	newHeader.Set("Host", req.Host)
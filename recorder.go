@@ -0,0 +1,40 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+)
+
+// withRecorderTrace lets the configured Recorder (if any) install an
+// httptrace.ClientTrace on the outbound request's context before it's sent
+// upstream, so it can capture DNS/connect/send/wait/receive timings.
+func (proxy *proxy) withRecorderTrace(ctx context.Context, req *http.Request) context.Context {
+	if proxy.Recorder == nil {
+		return ctx
+	}
+	type tracer interface {
+		Trace(context.Context, *http.Request) context.Context
+	}
+	if t, ok := proxy.Recorder.(tracer); ok {
+		return t.Trace(ctx, req)
+	}
+	return ctx
+}
+
+func (proxy *proxy) recordRequest(ctx context.Context, req *http.Request) {
+	if proxy.Recorder != nil {
+		proxy.Recorder.RecordRequest(ctx, req)
+	}
+}
+
+func (proxy *proxy) recordResponse(ctx context.Context, req *http.Request, resp *http.Response) {
+	if proxy.Recorder != nil {
+		proxy.Recorder.RecordResponse(ctx, req, resp)
+	}
+}
+
+func (proxy *proxy) recordConnect(ctx context.Context, upstreamAddr string, bytesUp, bytesDown int64) {
+	if proxy.Recorder != nil {
+		proxy.Recorder.RecordConnect(ctx, upstreamAddr, bytesUp, bytesDown)
+	}
+}
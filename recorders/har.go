@@ -0,0 +1,217 @@
+package recorders
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptrace"
+	"os"
+	"sync"
+	"time"
+)
+
+// HARRecorder accumulates entries in HAR 1.2 (http://www.softwareishard.com/blog/har-12-spec/)
+// format and flushes the log to Path when Close is called. Timings for each
+// entry are captured via an httptrace.ClientTrace installed by Trace on the
+// outbound request's context.
+type HARRecorder struct {
+	Path string
+
+	mu      sync.Mutex
+	entries []harEntry
+}
+
+// NewHARRecorder returns a Recorder that builds up a HAR log in memory and
+// writes it to path on Close.
+func NewHARRecorder(path string) *HARRecorder {
+	return &HARRecorder{Path: path}
+}
+
+type requestTimings struct {
+	start     time.Time
+	dnsStart  time.Time
+	dnsDone   time.Time
+	connStart time.Time
+	connDone  time.Time
+	wroteReq  time.Time
+	firstByte time.Time
+}
+
+// requestTimingsKey is the context key Trace uses to carry a request's
+// *requestTimings through to RecordRequest/RecordResponse. A map keyed by
+// *http.Request doesn't work here: the caller reassigns req to
+// req.WithContext(...) before round-tripping it, which returns a new
+// *http.Request, orphaning any entry keyed by the original pointer and
+// leaking it forever. The context, unlike the pointer, is threaded through
+// WithContext, so stashing the record there keeps it reachable.
+type requestTimingsKey struct{}
+
+// Trace installs an httptrace.ClientTrace on ctx that records the timings
+// HARRecorder needs for req, and returns a context carrying the resulting
+// *requestTimings so RecordRequest/RecordResponse can find it later via
+// req.Context(). Callers should use the returned context for the outbound
+// RoundTrip.
+func (h *HARRecorder) Trace(ctx context.Context, req *http.Request) context.Context {
+	t := &requestTimings{start: time.Now()}
+	trace := &httptrace.ClientTrace{
+		DNSStart:             func(httptrace.DNSStartInfo) { t.dnsStart = time.Now() },
+		DNSDone:              func(httptrace.DNSDoneInfo) { t.dnsDone = time.Now() },
+		ConnectStart:         func(string, string) { t.connStart = time.Now() },
+		ConnectDone:          func(string, string, error) { t.connDone = time.Now() },
+		WroteRequest:         func(httptrace.WroteRequestInfo) { t.wroteReq = time.Now() },
+		GotFirstResponseByte: func() { t.firstByte = time.Now() },
+	}
+	ctx = httptrace.WithClientTrace(ctx, trace)
+	return context.WithValue(ctx, requestTimingsKey{}, t)
+}
+
+// RecordRequest implements Recorder. The timings record itself lives in
+// req's context (see Trace); there's nothing to do here.
+func (h *HARRecorder) RecordRequest(ctx context.Context, req *http.Request) {
+}
+
+// RecordResponse implements Recorder.
+func (h *HARRecorder) RecordResponse(ctx context.Context, req *http.Request, resp *http.Response) {
+	t, ok := req.Context().Value(requestTimingsKey{}).(*requestTimings)
+	if !ok {
+		// Trace was never called for this request; fall back to a record with
+		// no captured timings rather than dropping the entry.
+		t = &requestTimings{start: time.Now()}
+	}
+	now := time.Now()
+
+	entry := harEntry{
+		StartedDateTime: t.start.Format(time.RFC3339Nano),
+		Time:            float64(now.Sub(t.start)) / float64(time.Millisecond),
+		Request:         harRequest(req),
+		Response:        harResponse(resp),
+		Timings:         harTimings(t, now),
+	}
+
+	h.mu.Lock()
+	h.entries = append(h.entries, entry)
+	h.mu.Unlock()
+}
+
+// RecordConnect implements Recorder by emitting a synthetic entry carrying
+// the byte counts piped through the CONNECT tunnel, since there's no
+// individual HTTP request/response to describe.
+func (h *HARRecorder) RecordConnect(ctx context.Context, upstreamAddr string, bytesUp, bytesDown int64) {
+	entry := harEntry{
+		StartedDateTime: time.Now().Format(time.RFC3339Nano),
+		Request: harRequestInfo{
+			Method:      "CONNECT",
+			URL:         upstreamAddr,
+			HTTPVersion: "HTTP/1.1",
+			BodySize:    bytesUp,
+		},
+		Response: harResponseInfo{
+			Status:      200,
+			StatusText:  "Connection Established",
+			HTTPVersion: "HTTP/1.1",
+			BodySize:    bytesDown,
+		},
+	}
+	h.mu.Lock()
+	h.entries = append(h.entries, entry)
+	h.mu.Unlock()
+}
+
+// Close writes the accumulated entries to h.Path as a HAR 1.2 document.
+func (h *HARRecorder) Close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	doc := harDocument{Log: harLog{
+		Version: "1.2",
+		Creator: harCreator{Name: "getlantern/proxy", Version: "1.0"},
+		Entries: h.entries,
+	}}
+	f, err := os.Create(h.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return json.NewEncoder(f).Encode(doc)
+}
+
+func harRequest(req *http.Request) harRequestInfo {
+	return harRequestInfo{
+		Method:      req.Method,
+		URL:         req.URL.String(),
+		HTTPVersion: req.Proto,
+		BodySize:    req.ContentLength,
+	}
+}
+
+func harResponse(resp *http.Response) harResponseInfo {
+	if resp == nil {
+		return harResponseInfo{Status: 0}
+	}
+	return harResponseInfo{
+		Status:      resp.StatusCode,
+		StatusText:  http.StatusText(resp.StatusCode),
+		HTTPVersion: resp.Proto,
+		BodySize:    resp.ContentLength,
+	}
+}
+
+func harTimings(t *requestTimings, end time.Time) harTimingsInfo {
+	ms := func(start, stop time.Time) float64 {
+		if start.IsZero() || stop.IsZero() || stop.Before(start) {
+			return -1
+		}
+		return float64(stop.Sub(start)) / float64(time.Millisecond)
+	}
+	return harTimingsInfo{
+		DNS:     ms(t.dnsStart, t.dnsDone),
+		Connect: ms(t.connStart, t.connDone),
+		Send:    ms(t.start, t.wroteReq),
+		Wait:    ms(t.wroteReq, t.firstByte),
+		Receive: ms(t.firstByte, end),
+	}
+}
+
+type harDocument struct {
+	Log harLog `json:"log"`
+}
+
+type harLog struct {
+	Version string     `json:"version"`
+	Creator harCreator `json:"creator"`
+	Entries []harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime string          `json:"startedDateTime"`
+	Time            float64         `json:"time"`
+	Request         harRequestInfo  `json:"request"`
+	Response        harResponseInfo `json:"response"`
+	Timings         harTimingsInfo  `json:"timings"`
+}
+
+type harRequestInfo struct {
+	Method      string `json:"method"`
+	URL         string `json:"url"`
+	HTTPVersion string `json:"httpVersion"`
+	BodySize    int64  `json:"bodySize"`
+}
+
+type harResponseInfo struct {
+	Status      int    `json:"status"`
+	StatusText  string `json:"statusText"`
+	HTTPVersion string `json:"httpVersion"`
+	BodySize    int64  `json:"bodySize"`
+}
+
+type harTimingsInfo struct {
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
@@ -0,0 +1,52 @@
+package recorders
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+// TestHARRecorderSurvivesWithContext reproduces the caller's real sequence:
+// Trace is used to derive a new context, that context is attached to the
+// request via WithContext (which returns a different *http.Request), and
+// only then are RecordRequest/RecordResponse called. Timings keyed by the
+// original request pointer would never be found again.
+func TestHARRecorderSurvivesWithContext(t *testing.T) {
+	dir := t.TempDir()
+	path := dir + "/out.har"
+	h := NewHARRecorder(path)
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	ctx := h.Trace(context.Background(), req)
+	req = req.WithContext(ctx) // returns a new *http.Request, per net/http
+
+	h.RecordRequest(ctx, req)
+	time.Sleep(time.Millisecond)
+	resp := &http.Response{StatusCode: 200, Proto: "HTTP/1.1"}
+	h.RecordResponse(ctx, req, resp)
+
+	if err := h.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer f.Close()
+
+	var doc harDocument
+	if err := json.NewDecoder(f).Decode(&doc); err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if len(doc.Log.Entries) != 1 {
+		t.Fatalf("entries = %d, want 1", len(doc.Log.Entries))
+	}
+	if doc.Log.Entries[0].Time <= 0 {
+		t.Errorf("entry Time = %v, want > 0 (timings record should not have been orphaned)", doc.Log.Entries[0].Time)
+	}
+}
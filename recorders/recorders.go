@@ -0,0 +1,26 @@
+// Package recorders provides pluggable recording of the traffic that passes
+// through a proxy, for operators who want to observe MITM'd flows without
+// wrapping the filters.Chain by hand.
+package recorders
+
+import (
+	"context"
+	"net/http"
+)
+
+// Recorder observes requests, responses and CONNECT tunnels as they pass
+// through the proxy. Implementations must be safe for concurrent use, since
+// they're invoked from every downstream connection's goroutine.
+type Recorder interface {
+	// RecordRequest is called with the request as it's about to be sent
+	// upstream.
+	RecordRequest(ctx context.Context, req *http.Request)
+
+	// RecordResponse is called with the response received from upstream for
+	// req (resp may be nil if the round trip failed).
+	RecordResponse(ctx context.Context, req *http.Request, resp *http.Response)
+
+	// RecordConnect is called once a CONNECT tunnel to upstreamAddr has
+	// finished, with the total bytes copied in each direction.
+	RecordConnect(ctx context.Context, upstreamAddr string, bytesUp, bytesDown int64)
+}
@@ -0,0 +1,276 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/getlantern/errors"
+)
+
+// SOCKS protocol constants, as defined by RFC 1928 (SOCKS5) and the SOCKS4A
+// extension to Tor/SOCKS4.
+const (
+	socks5Version = 0x05
+	socks4Version = 0x04
+
+	socks5AuthNone     = 0x00
+	socks5AuthPassword = 0x02
+	socks5AuthNoAccept = 0xff
+
+	socks5CmdConnect      = 0x01
+	socks5CmdBind         = 0x02
+	socks5CmdUDPAssociate = 0x03
+
+	socks5AddrIPv4   = 0x01
+	socks5AddrDomain = 0x03
+	socks5AddrIPv6   = 0x04
+
+	socks5ReplySucceeded           = 0x00
+	socks5ReplyGeneralFailure      = 0x01
+	socks5ReplyCommandNotSupported = 0x07
+
+	socks4CmdConnect = 0x01
+	socks4Granted    = 90
+	socks4Rejected   = 91
+)
+
+// SOCKSAuth, if set on Opts, is consulted to authorize SOCKS5 username/
+// password authentication (RFC 1929). Returning false rejects the SOCKS
+// handshake.
+type SOCKSAuth func(user, password string) bool
+
+// ServeSOCKS serves conn as a SOCKS5 (RFC 1928, with optional username/
+// password auth per RFC 1929) or SOCKS4a front-end, funneling the resulting
+// CONNECT target into the same proceedWithConnect path used by HTTP CONNECT
+// so MITM, BufferSource, filters.Chain and RequestAware/ResponseAware all
+// behave identically regardless of which front-end the client spoke.
+func (proxy *proxy) ServeSOCKS(ctx context.Context, conn net.Conn) error {
+	defer func() {
+		if closeErr := conn.Close(); closeErr != nil {
+			log.Tracef("Error closing SOCKS connection: %s", closeErr)
+		}
+	}()
+
+	r := bufio.NewReader(conn)
+	version, err := r.Peek(1)
+	if err != nil {
+		return errors.New("Error reading SOCKS version byte: %v", err)
+	}
+
+	switch version[0] {
+	case socks5Version:
+		return proxy.serveSOCKS5(ctx, conn, r)
+	case socks4Version:
+		return proxy.serveSOCKS4a(ctx, conn, r)
+	default:
+		return errors.New("Unrecognized SOCKS version byte: %#x", version[0])
+	}
+}
+
+func (proxy *proxy) serveSOCKS5(ctx context.Context, conn net.Conn, r *bufio.Reader) error {
+	if _, err := r.Discard(1); err != nil {
+		return err
+	}
+	nmethods, err := r.ReadByte()
+	if err != nil {
+		return err
+	}
+	methods := make([]byte, nmethods)
+	if _, err := io.ReadFull(r, methods); err != nil {
+		return err
+	}
+
+	method := byte(socks5AuthNoAccept)
+	wantPassword := false
+	for _, m := range methods {
+		if m == socks5AuthPassword && proxy.SOCKSAuth != nil {
+			method = socks5AuthPassword
+			wantPassword = true
+		} else if m == socks5AuthNone && proxy.SOCKSAuth == nil && method == socks5AuthNoAccept {
+			method = socks5AuthNone
+		}
+	}
+	if _, err := conn.Write([]byte{socks5Version, method}); err != nil {
+		return err
+	}
+	if method == socks5AuthNoAccept {
+		return errors.New("No acceptable SOCKS5 authentication method offered")
+	}
+
+	if wantPassword {
+		if err := proxy.socks5Authenticate(conn, r); err != nil {
+			return err
+		}
+	}
+
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return err
+	}
+	if header[0] != socks5Version {
+		return errors.New("Unexpected SOCKS5 version in request: %#x", header[0])
+	}
+	cmd := header[1]
+	addrType := header[3]
+
+	if cmd != socks5CmdConnect {
+		proxy.writeSOCKS5Reply(conn, socks5ReplyCommandNotSupported, nil)
+		return errors.New("Rejected unsupported SOCKS5 command: %#x", cmd)
+	}
+
+	host, err := readSOCKS5Addr(r, addrType)
+	if err != nil {
+		proxy.writeSOCKS5Reply(conn, socks5ReplyGeneralFailure, nil)
+		return err
+	}
+	var portBytes [2]byte
+	if _, err := io.ReadFull(r, portBytes[:]); err != nil {
+		return err
+	}
+	port := binary.BigEndian.Uint16(portBytes[:])
+	origin := fmt.Sprintf("%v:%v", host, port)
+
+	if writeErr := proxy.writeSOCKS5Reply(conn, socks5ReplySucceeded, conn.LocalAddr()); writeErr != nil {
+		return writeErr
+	}
+
+	return proxy.Connect(ctx, r, conn, origin)
+}
+
+func (proxy *proxy) socks5Authenticate(conn net.Conn, r *bufio.Reader) error {
+	if _, err := r.Discard(1); err != nil { // auth sub-negotiation version
+		return err
+	}
+	ulen, err := r.ReadByte()
+	if err != nil {
+		return err
+	}
+	user := make([]byte, ulen)
+	if _, err := io.ReadFull(r, user); err != nil {
+		return err
+	}
+	plen, err := r.ReadByte()
+	if err != nil {
+		return err
+	}
+	password := make([]byte, plen)
+	if _, err := io.ReadFull(r, password); err != nil {
+		return err
+	}
+
+	ok := proxy.SOCKSAuth(string(user), string(password))
+	status := byte(1)
+	if ok {
+		status = 0
+	}
+	if _, err := conn.Write([]byte{0x01, status}); err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("SOCKS5 authentication failed for user %q", user)
+	}
+	return nil
+}
+
+func readSOCKS5Addr(r *bufio.Reader, addrType byte) (string, error) {
+	switch addrType {
+	case socks5AddrIPv4:
+		b := make([]byte, net.IPv4len)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return "", err
+		}
+		return net.IP(b).String(), nil
+	case socks5AddrIPv6:
+		b := make([]byte, net.IPv6len)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return "", err
+		}
+		return net.IP(b).String(), nil
+	case socks5AddrDomain:
+		l, err := r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		b := make([]byte, l)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return "", err
+		}
+		return string(b), nil
+	default:
+		return "", errors.New("Unrecognized SOCKS5 address type: %#x", addrType)
+	}
+}
+
+// writeSOCKS5Reply writes a SOCKS5 reply with the given status, using addr
+// (if non-nil and a *net.TCPAddr with an IPv4 address) to fill in the bound
+// address, or the IPv4 zero address otherwise, which is what most clients
+// expect for a CONNECT reply.
+func (proxy *proxy) writeSOCKS5Reply(conn net.Conn, status byte, addr net.Addr) error {
+	reply := []byte{socks5Version, status, 0x00, socks5AddrIPv4, 0, 0, 0, 0, 0, 0}
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok && tcpAddr.IP.To4() != nil {
+		copy(reply[4:8], tcpAddr.IP.To4())
+		binary.BigEndian.PutUint16(reply[8:10], uint16(tcpAddr.Port))
+	}
+	_, err := conn.Write(reply)
+	return err
+}
+
+// serveSOCKS4a handles the SOCKS4 CONNECT command and its SOCKS4a extension
+// (domain names instead of a resolved IP, signaled by an IP of 0.0.0.x with
+// x != 0).
+func (proxy *proxy) serveSOCKS4a(ctx context.Context, conn net.Conn, r *bufio.Reader) error {
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return err
+	}
+	cmd := header[1]
+	port := binary.BigEndian.Uint16(header[2:4])
+	ip := net.IP(header[4:8])
+
+	// USERID, NUL-terminated; we don't authenticate on it but must consume it.
+	if _, err := r.ReadBytes(0x00); err != nil {
+		return err
+	}
+
+	if cmd != socks4CmdConnect {
+		proxy.writeSOCKS4Reply(conn, socks4Rejected)
+		return errors.New("Rejected unsupported SOCKS4 command: %#x", cmd)
+	}
+
+	host, err := socks4aHost(ip, r)
+	if err != nil {
+		proxy.writeSOCKS4Reply(conn, socks4Rejected)
+		return err
+	}
+
+	origin := fmt.Sprintf("%v:%v", host, port)
+	if err := proxy.writeSOCKS4Reply(conn, socks4Granted); err != nil {
+		return err
+	}
+	return proxy.Connect(ctx, r, conn, origin)
+}
+
+// socks4aHost returns the CONNECT target host for a SOCKS4 request: ip's
+// string form normally, or, per the SOCKS4a extension, a NUL-terminated
+// domain name read from r when ip is the 0.0.0.x (x != 0) sentinel a client
+// uses to signal that it couldn't resolve the domain itself.
+func socks4aHost(ip net.IP, r *bufio.Reader) (string, error) {
+	if ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0 {
+		domain, err := r.ReadBytes(0x00)
+		if err != nil {
+			return "", err
+		}
+		return string(domain[:len(domain)-1]), nil
+	}
+	return ip.String(), nil
+}
+
+func (proxy *proxy) writeSOCKS4Reply(conn net.Conn, status byte) error {
+	reply := []byte{0x00, status, 0, 0, 0, 0, 0, 0}
+	_, err := conn.Write(reply)
+	return err
+}
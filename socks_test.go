@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestReadSOCKS5AddrIPv4(t *testing.T) {
+	r := bufio.NewReader(bytes.NewReader([]byte{203, 0, 113, 7}))
+	host, err := readSOCKS5Addr(r, socks5AddrIPv4)
+	if err != nil {
+		t.Fatalf("readSOCKS5Addr: %v", err)
+	}
+	if want := "203.0.113.7"; host != want {
+		t.Errorf("host = %q, want %q", host, want)
+	}
+}
+
+func TestReadSOCKS5AddrIPv6(t *testing.T) {
+	ip := net.ParseIP("2001:db8::1")
+	r := bufio.NewReader(bytes.NewReader(ip.To16()))
+	host, err := readSOCKS5Addr(r, socks5AddrIPv6)
+	if err != nil {
+		t.Fatalf("readSOCKS5Addr: %v", err)
+	}
+	if want := ip.String(); host != want {
+		t.Errorf("host = %q, want %q", host, want)
+	}
+}
+
+func TestReadSOCKS5AddrDomain(t *testing.T) {
+	domain := "example.com"
+	buf := append([]byte{byte(len(domain))}, domain...)
+	r := bufio.NewReader(bytes.NewReader(buf))
+	host, err := readSOCKS5Addr(r, socks5AddrDomain)
+	if err != nil {
+		t.Fatalf("readSOCKS5Addr: %v", err)
+	}
+	if host != domain {
+		t.Errorf("host = %q, want %q", host, domain)
+	}
+}
+
+func TestReadSOCKS5AddrUnrecognizedType(t *testing.T) {
+	r := bufio.NewReader(bytes.NewReader(nil))
+	if _, err := readSOCKS5Addr(r, 0x99); err == nil {
+		t.Error("readSOCKS5Addr with an unrecognized address type should error")
+	}
+}
+
+func TestSocks4aHostUsesIPWhenNotSentinel(t *testing.T) {
+	// 4-byte form, as serveSOCKS4a constructs it from the wire header
+	// (net.IP(header[4:8])); a 16-byte net.IPv4(...) would shift the octets
+	// socks4aHost inspects.
+	ip := net.IP{203, 0, 113, 7}
+	host, err := socks4aHost(ip, bufio.NewReader(bytes.NewReader(nil)))
+	if err != nil {
+		t.Fatalf("socks4aHost: %v", err)
+	}
+	if want := ip.String(); host != want {
+		t.Errorf("host = %q, want %q", host, want)
+	}
+}
+
+func TestSocks4aHostReadsDomainForSentinel(t *testing.T) {
+	ip := net.IP{0, 0, 0, 1}
+	r := bufio.NewReader(bytes.NewReader([]byte("example.com\x00")))
+	host, err := socks4aHost(ip, r)
+	if err != nil {
+		t.Fatalf("socks4aHost: %v", err)
+	}
+	if want := "example.com"; host != want {
+		t.Errorf("host = %q, want %q", host, want)
+	}
+}
+
+func TestSocks4aHostNotSentinelWhenLastOctetZero(t *testing.T) {
+	// 0.0.0.0 isn't the SOCKS4a sentinel (that requires a non-zero last
+	// octet), so it should be treated as a literal (if useless) IP.
+	ip := net.IP{0, 0, 0, 0}
+	host, err := socks4aHost(ip, bufio.NewReader(bytes.NewReader(nil)))
+	if err != nil {
+		t.Fatalf("socks4aHost: %v", err)
+	}
+	if want := ip.String(); host != want {
+		t.Errorf("host = %q, want %q", host, want)
+	}
+}
@@ -0,0 +1,54 @@
+package proxy
+
+import (
+	"net"
+	"sync/atomic"
+
+	"github.com/getlantern/netx"
+)
+
+func (opts *Opts) applySpliceDefaults() {
+	// DisableSplice defaults to false; nothing to do, but kept for symmetry
+	// with the other applyXDefaults methods.
+}
+
+// splicedBytes and bufferedBytes back SpliceStats; they live here, in a file
+// with no build tag, because bufferedCopy (also untagged, so it compiles on
+// every platform) needs to update bufferedBytes regardless of whether the
+// platform-specific SpliceCopy in splice_linux.go or splice_other.go is the
+// one in play.
+var (
+	splicedBytes  int64
+	bufferedBytes int64
+)
+
+// SpliceStats reports the cumulative bytes that have gone through the
+// splice fast path versus the buffered userspace copy, so operators can
+// confirm the fast path is engaging under load. On platforms without a
+// splice(2) equivalent, Spliced is always zero.
+type SpliceStats struct {
+	Spliced  int64
+	Buffered int64
+}
+
+func spliceStats() SpliceStats {
+	return SpliceStats{
+		Spliced:  atomic.LoadInt64(&splicedBytes),
+		Buffered: atomic.LoadInt64(&bufferedBytes),
+	}
+}
+
+// bufferedCopy is the userspace fallback used when SpliceCopy can't take the
+// zero-copy path: two 64K buffers and netx.BidiCopy, same as
+// proceedWithConnect did before SpliceCopy existed. It returns the number of
+// bytes copied from downstream to upstream (bytesUp) and from upstream to
+// downstream (bytesDown).
+func bufferedCopy(upstream, downstream net.Conn, bufOut, bufIn []byte) (bytesUp, bytesDown int64, writeErr, readErr error) {
+	countedUpstream := &byteCountingConn{Conn: upstream}
+	countedDownstream := &byteCountingConn{Conn: downstream}
+	writeErr, readErr = netx.BidiCopy(countedUpstream, countedDownstream, bufOut, bufIn)
+	bytesDown = countedUpstream.read
+	bytesUp = countedDownstream.read
+	atomic.AddInt64(&bufferedBytes, bytesUp+bytesDown)
+	return bytesUp, bytesDown, writeErr, readErr
+}
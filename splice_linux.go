@@ -0,0 +1,46 @@
+// +build linux
+
+package proxy
+
+import (
+	"net"
+	"sync/atomic"
+)
+
+// SpliceCopy pipes data bidirectionally between upstream and downstream. On
+// Linux, when both are *net.TCPConn and MITM is not active, it bypasses the
+// usual buffered copy and drives each direction with
+// (*net.TCPConn).ReadFrom, which uses splice(2) under the hood and avoids
+// copying data through userspace at all. Otherwise it falls back to
+// bufferedCopy. It returns the bytes copied from downstream to upstream
+// (bytesUp) and from upstream to downstream (bytesDown).
+func (proxy *proxy) SpliceCopy(upstream, downstream net.Conn, bufOut, bufIn []byte) (bytesUp, bytesDown int64, writeErr, readErr error) {
+	upstreamTCP, upOK := upstream.(*net.TCPConn)
+	downstreamTCP, downOK := downstream.(*net.TCPConn)
+	if proxy.DisableSplice || !upOK || !downOK {
+		return bufferedCopy(upstream, downstream, bufOut, bufIn)
+	}
+
+	type result struct {
+		n   int64
+		err error
+	}
+	upCh := make(chan result, 1)
+	downCh := make(chan result, 1)
+
+	go func() {
+		// Reads from downstream, writes to upstream: the "up" direction.
+		n, err := upstreamTCP.ReadFrom(downstreamTCP)
+		upCh <- result{n, err}
+	}()
+	go func() {
+		// Reads from upstream, writes to downstream: the "down" direction.
+		n, err := downstreamTCP.ReadFrom(upstreamTCP)
+		downCh <- result{n, err}
+	}()
+
+	up := <-upCh
+	down := <-downCh
+	atomic.AddInt64(&splicedBytes, up.n+down.n)
+	return up.n, down.n, up.err, down.err
+}
@@ -0,0 +1,11 @@
+// +build !linux
+
+package proxy
+
+import "net"
+
+// SpliceCopy falls back directly to bufferedCopy on platforms without a
+// splice(2) equivalent wired up.
+func (proxy *proxy) SpliceCopy(upstream, downstream net.Conn, bufOut, bufIn []byte) (bytesUp, bytesDown int64, writeErr, readErr error) {
+	return bufferedCopy(upstream, downstream, bufOut, bufIn)
+}
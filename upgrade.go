@@ -0,0 +1,151 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/netx"
+	"github.com/getlantern/proxy/filters"
+)
+
+// upgradeCtxKey is an unexported, unexported-type context key so it can't
+// collide with any other key stored on a filters.Context, used to flag a
+// request as an in-flight protocol upgrade so the outbound RoundTrip path
+// knows to keep the Connection/Upgrade headers that would otherwise be
+// stripped as hop-by-hop.
+type upgradeCtxKey struct{}
+
+// isUpgradeCtx reports whether ctx was marked by proceedWithUpgrade.
+func isUpgradeCtx(ctx context.Context) bool {
+	marked, _ := ctx.Value(upgradeCtxKey{}).(bool)
+	return marked
+}
+
+func (opts *Opts) applyUpgradeDefaults() {
+	if opts.UpgradeProtocols == nil {
+		opts.UpgradeProtocols = []string{"websocket"}
+	}
+}
+
+// isUpgradeRequest reports whether req is asking to switch to one of the
+// protocols configured on Opts.UpgradeProtocols via the Upgrade header.
+func (proxy *proxy) isUpgradeRequest(req *http.Request) bool {
+	if !hasToken(req.Header.Get("Connection"), "upgrade") {
+		return false
+	}
+	upgrade := strings.ToLower(req.Header.Get("Upgrade"))
+	if upgrade == "" {
+		return false
+	}
+	for _, allowed := range proxy.UpgradeProtocols {
+		if strings.ToLower(allowed) == upgrade {
+			return true
+		}
+	}
+	return false
+}
+
+// hasToken reports whether token (case-insensitive) appears among the
+// comma-separated values of header.
+func hasToken(header, token string) bool {
+	for _, v := range strings.Split(header, ",") {
+		if strings.EqualFold(strings.TrimSpace(v), token) {
+			return true
+		}
+	}
+	return false
+}
+
+// copyUpgradeHeaders copies the Connection, Upgrade and Sec-WebSocket-*
+// headers verbatim, unlike copyHeadersForForwarding which strips Connection
+// and Upgrade as hop-by-hop. Any values dst already holds for these headers
+// are replaced, so copying onto a header set that already carries them does
+// not duplicate them.
+func copyUpgradeHeaders(dst, src http.Header) {
+	for k, vv := range src {
+		lk := strings.ToLower(k)
+		if lk == "connection" || lk == "upgrade" || strings.HasPrefix(lk, "sec-websocket-") {
+			dst[k] = append([]string(nil), vv...)
+		}
+	}
+}
+
+// proceedWithUpgrade performs the upstream round-trip for req, and if the
+// response is a 101 Switching Protocols, hijacks downstream, relays the
+// response headers and then pipes raw bytes between downstream and the
+// underlying upstream connection obtained from the transport, analogous to
+// how net/http/httputil.ReverseProxy.handleUpgradeResponse works.
+func (proxy *proxy) proceedWithUpgrade(ctx filters.Context, req *http.Request, downstream net.Conn, next filters.Next) (*http.Response, filters.Context, error) {
+	upgradeReq := req.Clone(req.Context())
+	copyUpgradeHeaders(upgradeReq.Header, req.Header)
+
+	resp, nextCtx, err := next(ctx.WithValue(upgradeCtxKey{}, true), upgradeReq)
+	if err != nil {
+		return resp, nextCtx, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		// Origin declined to switch protocols; let the caller write resp as a
+		// regular response.
+		return resp, nextCtx, nil
+	}
+
+	upstreamConn, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		return nil, nextCtx, errors.New("upstream response body does not support hijacking for upgrade")
+	}
+
+	hj, ok := downstream.(http.Hijacker)
+	var downstreamConn net.Conn = downstream
+	var downstreamBuffered *bufio.ReadWriter
+	if ok {
+		var hijackErr error
+		downstreamConn, downstreamBuffered, hijackErr = hj.Hijack()
+		if hijackErr != nil {
+			return nil, nextCtx, errors.New("Unable to hijack downstream connection for upgrade: %v", hijackErr)
+		}
+	}
+
+	respHeader := make(http.Header)
+	copyUpgradeHeaders(respHeader, resp.Header)
+	if writeErr := writeUpgradeResponse(downstreamConn, resp, respHeader); writeErr != nil {
+		return nil, nextCtx, errors.New("Unable to write upgrade response to downstream: %v", writeErr)
+	}
+	if downstreamBuffered != nil {
+		downstreamBuffered.Writer.Flush()
+	}
+
+	bufOut := proxy.BufferSource.Get()
+	bufIn := proxy.BufferSource.Get()
+	defer proxy.BufferSource.Put(bufOut)
+	defer proxy.BufferSource.Put(bufIn)
+
+	writeErr, readErr := netx.BidiCopy(upstreamConn, downstreamConn, bufOut, bufIn)
+	if isUnexpected(readErr) {
+		return nil, nextCtx, errors.New("Error piping upgraded data to downstream: %v", readErr)
+	} else if isUnexpected(writeErr) {
+		return nil, nextCtx, errors.New("Error piping upgraded data to upstream: %v", writeErr)
+	}
+	// nil response and nil error tells processRequests that we've already
+	// fully piped the upgraded connection to completion.
+	return nil, nextCtx, nil
+}
+
+// writeUpgradeResponse writes the 101 status line and headers to downstream
+// the way (*http.Response).Write would, but without risking it closing or
+// buffering the body, since the body is actually the live upstream
+// connection by this point.
+func writeUpgradeResponse(downstream net.Conn, resp *http.Response, header http.Header) error {
+	if _, err := io.WriteString(downstream, "HTTP/1.1 101 Switching Protocols\r\n"); err != nil {
+		return err
+	}
+	if err := header.Write(downstream); err != nil {
+		return err
+	}
+	_, err := io.WriteString(downstream, "\r\n")
+	return err
+}
@@ -0,0 +1,43 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPrepareUpgradeRequestPreservesUpgradeHeaders(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/ws", nil)
+	req.Host = "example.com"
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+
+	prepared := prepareUpgradeRequest(req)
+
+	if got := prepared.Header.Get("Connection"); got != "Upgrade" {
+		t.Errorf("Connection header = %q, want %q", got, "Upgrade")
+	}
+	if got := prepared.Header.Get("Upgrade"); got != "websocket" {
+		t.Errorf("Upgrade header = %q, want %q", got, "websocket")
+	}
+	if got := prepared.Header.Get("Sec-WebSocket-Key"); got != "dGhlIHNhbXBsZSBub25jZQ==" {
+		t.Errorf("Sec-WebSocket-Key header = %q, want preserved value", got)
+	}
+}
+
+func TestPrepareRequestStripsUpgradeHeaders(t *testing.T) {
+	// prepareRequest (the non-upgrade path) must keep stripping these as
+	// hop-by-hop; only prepareUpgradeRequest should preserve them.
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.Host = "example.com"
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+
+	prepared := prepareRequest(req)
+
+	if got := prepared.Header.Get("Upgrade"); got != "" {
+		t.Errorf("Upgrade header = %q, want empty", got)
+	}
+}